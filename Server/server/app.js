@@ -1,9 +1,17 @@
 import axios from 'axios';
 import bodyParser from 'body-parser';
-import { assert } from 'console';
+import crypto from 'crypto';
 import express from 'express';
 import fs from 'fs';
+import https from 'https';
 import { exit } from 'process';
+import {
+  createVerifier,
+  generateCode,
+  normalizePhone,
+  runInTurn,
+  wholeNumberSetting
+} from './otp.js';
 
 const app = express();
 
@@ -16,19 +24,523 @@ const filename = "whatsapp-info.json";
 
 const apiVersion = "v16.0";
 
+// identifies the sample in Meta's logs, which helps with support cases
+const userAgent =
+  process.env.GRAPH_API_USER_AGENT || 'WhatsApp-OTP-Sample-Server/1.0.0 (node)';
+
+// One client for every outbound call, keeping connections to Meta alive
+// between requests instead of opening a new one per send. The timeout stops
+// a call that never completes from holding a request open forever.
+const httpTimeoutInMs = 30 * 1000;
+const httpClient = axios.create({
+  httpsAgent: new https.Agent({ keepAlive: true, maxSockets: 50 }),
+  timeout: httpTimeoutInMs,
+  headers: { 'User-Agent': userAgent }
+});
+
+// dumping every active code on each request is handy in development but
+// noisy (and exposes codes) in production
+const logActiveCodes = process.env.NODE_ENV !== 'production';
+
+// When set, active codes are stored under sha256(phone + salt) rather than
+// the phone number itself, so a memory dump doesn't reveal which phones have
+// codes. Off by default, since it makes the active codes table opaque.
+const phoneKeySalt = process.env.PHONE_KEY_SALT || null;
+
+// Startup Graph API lookups that fail transiently (no response, 429 or 5xx)
+// are retried up to MAX_STARTUP_FETCH_ATTEMPTS times each, waiting 1s, 2s,
+// 4s, ... in between, so a brief outage doesn't stop the server starting.
+// No retry is started that would wait past STARTUP_FETCH_DEADLINE_SECONDS
+// after startup began, which bounds the total time spent across lookups.
+const maxStartupFetchAttempts =
+  wholeNumberSetting('MAX_STARTUP_FETCH_ATTEMPTS', 1, 10) ?? 5;
+const startupFetchDeadlineInSeconds =
+  wholeNumberSetting('STARTUP_FETCH_DEADLINE_SECONDS', 1, 60 * 60) ?? 60;
+const startupTime = Date.now();
+
+// upper bound on pages of phone numbers or templates to fetch at startup, in
+// case of a very large WABA or a paging loop
+const maxStartupPages =
+  wholeNumberSetting('MAX_STARTUP_PAGES', 1, 1000) ?? 50;
+
+// What to do when a code is requested for a phone that already has a valid
+// one: 'regenerate' (the default) sends a new code, 'reuse' sends the
+// existing code again without extending its lifetime, and 'reject' answers
+// 429 until the existing code expires.
+const existingCodePolicy = process.env.EXISTING_CODE_POLICY || 'regenerate';
+if (!['regenerate', 'reuse', 'reject'].includes(existingCodePolicy)) {
+  console.log(
+    "EXISTING_CODE_POLICY must be 'regenerate', 'reuse' or 'reject'."
+  );
+  exit();
+}
+
+// When set, active codes are stored as HMAC-SHA256(pepper, phone:code)
+// rather than in plain text, so a memory dump reveals no codes and the same
+// code stored for two phones looks different. Without the pepper, the
+// digests of every possible code can't be precomputed. The 'reuse' policy
+// has to resend the stored code, so it can't be combined with this.
+const codePepper = process.env.CODE_PEPPER || null;
+if (codePepper != null && codePepper.length < 32) {
+  console.log('CODE_PEPPER must be at least 32 characters.');
+  exit();
+} else if (codePepper != null && existingCodePolicy === 'reuse') {
+  console.log(
+    'CODE_PEPPER cannot be combined with EXISTING_CODE_POLICY=reuse.'
+  );
+  exit();
+}
+
+// 'template' (the default) sends codes with the approved authentication
+// template. 'text' sends them as plain text messages instead, e.g. while the
+// template is still in review. WhatsApp only delivers text messages within
+// 24 hours of the user last messaging the business, so this is for testing
+// with your own phone, never for reaching users cold.
+const sendMode = process.env.SEND_MODE || 'template';
+if (!['template', 'text'].includes(sendMode)) {
+  console.log("SEND_MODE must be 'template' or 'text'.");
+  exit();
+}
+
+// WhatsApp may still fail to deliver a message after accepting it, so clients
+// that understand this can ask for 202 Accepted (with the message ID) rather
+// than the default 200 OK on a successful send
+const sendSuccessStatus = Number(process.env.SEND_SUCCESS_STATUS || 200);
+if (sendSuccessStatus !== 200 && sendSuccessStatus !== 202) {
+  console.log('SEND_SUCCESS_STATUS must be 200 or 202.');
+  exit();
+}
+
+// When true, a failed send gets the same empty 200 as a successful one, and
+// the real outcome is only logged. Otherwise the 500 on failure (e.g. for a
+// number that is not on WhatsApp) lets anyone check which numbers are.
+const uniformSendResponse = process.env.UNIFORM_SEND_RESPONSE === 'true';
+if (uniformSendResponse && sendSuccessStatus !== 200) {
+  console.log(
+    'UNIFORM_SEND_RESPONSE requires SEND_SUCCESS_STATUS=200, since a ' +
+    'failed send has no message ID to answer 202 with.'
+  );
+  exit();
+}
+
+// When set, caps how many codes the whole server sends per minute, whatever
+// the phone or client. This is a blunt limit on WhatsApp spend for public
+// demos.
+const maxSendsPerMinute = wholeNumberSetting('MAX_SENDS_PER_MINUTE');
+
+// When set, each phone may only be sent this many codes within
+// SEND_QUOTA_WINDOW_SECONDS. A successful verification resets the phone's
+// quota, since the user has proven they own it, so only phones that keep
+// requesting codes without using them get throttled.
+const maxSendsPerPhone = wholeNumberSetting('MAX_SENDS_PER_PHONE');
+const sendQuotaWindowInSeconds = wholeNumberSetting(
+  'SEND_QUOTA_WINDOW_SECONDS', 1, 24 * 60 * 60
+) ?? 60 * 60;
+
+// When set, each client IP may only request codes for this many different
+// phone numbers within PHONES_PER_IP_WINDOW_SECONDS. This targets scripts
+// spraying codes at many numbers, which a per-phone or global rate limit
+// would let through.
+const maxPhonesPerIP = wholeNumberSetting('MAX_PHONES_PER_IP');
+const phonesPerIPWindowInSeconds = wholeNumberSetting(
+  'PHONES_PER_IP_WINDOW_SECONDS', 1, 24 * 60 * 60
+) ?? 60 * 60;
+
+// When set, a summary is POSTed to this URL (e.g. a Slack incoming webhook)
+// once SEND_FAILURE_ALERT_THRESHOLD sends have failed within
+// SEND_FAILURE_ALERT_WINDOW_SECONDS, at most once per window
+const sendFailureAlertURL = process.env.SEND_FAILURE_ALERT_URL || null;
+if (sendFailureAlertURL != null && !URL.canParse(sendFailureAlertURL)) {
+  console.log('SEND_FAILURE_ALERT_URL must be an absolute URL.');
+  exit();
+}
+const sendFailureAlertThreshold =
+  wholeNumberSetting('SEND_FAILURE_ALERT_THRESHOLD') ?? 5;
+const sendFailureAlertWindowInSeconds = wholeNumberSetting(
+  'SEND_FAILURE_ALERT_WINDOW_SECONDS', 1, 24 * 60 * 60
+) ?? 5 * 60;
+
+// When set, codes are only sent to these phone numbers. This is a safety
+// rail for demos and staging against a live WABA.
+const rawSandboxAllowedPhones = process.env.SANDBOX_ALLOWED_PHONES;
+let sandboxAllowedPhones = null;
+if (rawSandboxAllowedPhones) {
+  sandboxAllowedPhones = new Set();
+  for (const rawPhone of rawSandboxAllowedPhones.split(',')) {
+    const phone = normalizePhone(rawPhone);
+    if (phone == null) {
+      console.log(`Invalid phone # '${rawPhone}' in SANDBOX_ALLOWED_PHONES.`);
+      exit();
+    }
+    sandboxAllowedPhones.add(phone);
+  }
+}
+
+// When both are set, GET /otp/:phone_number requires a CAPTCHA token in the
+// X-Captcha-Token header, checked against the provider's siteverify API
+// before anything else is done. hCaptcha, reCAPTCHA and Cloudflare Turnstile
+// all take the same secret and response form fields there.
+const captchaVerifyURL = process.env.CAPTCHA_VERIFY_URL || null;
+const captchaSecret = process.env.CAPTCHA_SECRET || null;
+if ((captchaVerifyURL == null) !== (captchaSecret == null)) {
+  console.log('CAPTCHA_VERIFY_URL and CAPTCHA_SECRET must be set together.');
+  exit();
+} else if (captchaVerifyURL != null && !URL.canParse(captchaVerifyURL)) {
+  console.log('CAPTCHA_VERIFY_URL must be an absolute URL.');
+  exit();
+}
+
+// When both are set, POST /webhook receives WhatsApp message status
+// webhooks, signed with the app secret. A code whose message failed to
+// deliver is then deleted right away rather than living until it expires,
+// so the next verify tells the client to resend. GET /webhook answers Meta's
+// subscription check with WEBHOOK_VERIFY_TOKEN.
+const webhookVerifyToken = process.env.WEBHOOK_VERIFY_TOKEN || null;
+const webhookAppSecret = process.env.WEBHOOK_APP_SECRET || null;
+if ((webhookVerifyToken == null) !== (webhookAppSecret == null)) {
+  console.log(
+    'WEBHOOK_VERIFY_TOKEN and WEBHOOK_APP_SECRET must be set together.'
+  );
+  exit();
+}
+
+// Seconds after expiry during which a correct code still verifies, answering
+// "grace": true so the late success can be counted. Capped at a minute so
+// the grace period can't be used to stretch the code lifetime.
+const expiryGraceInSeconds =
+  wholeNumberSetting('EXPIRY_GRACE_SECONDS', 0, 60) ?? 0;
+
+// A small tolerance for clock drift, added to every expiry check. Unlike the
+// grace period, codes verified within it are simply on time.
+const clockSkewInSeconds =
+  wholeNumberSetting('CLOCK_SKEW_SECONDS', 0, 30) ?? 0;
+
+// When set, send and verify events are appended to this file as JSON lines,
+// with masked phone numbers, for later analytics. Each event is written as
+// it happens, so nothing builds up in memory and the file can be rotated by
+// moving it aside.
+const analyticsLogFile = process.env.ANALYTICS_LOG_FILE || null;
+
+// When set, GET /admin/logstream streams the same events as Server-Sent
+// Events to clients presenting this token as a bearer token, e.g. to show
+// server activity during a live demo
+const logStreamToken = process.env.LOG_STREAM_TOKEN || null;
+
+// When set, the /stats counters are also logged as one JSON line at this
+// interval, for deployments where nothing polls the endpoint. Node timers
+// misfire past 2^31 - 1 ms, which caps the interval at about 24 days.
+const statsLogIntervalInSeconds = wholeNumberSetting(
+  'STATS_LOG_INTERVAL_SECONDS', 1, Math.floor((2 ** 31 - 1) / 1000));
+
+// When set, a phone that verified within this many seconds gets the same
+// success response again if it resubmits the same code, e.g. a client
+// retrying after its connection dropped. Other codes still get 404.
+const verifyRetryWindowInSeconds =
+  wholeNumberSetting('VERIFY_RETRY_WINDOW_SECONDS', 1, 60);
+
+// upper bound on remembered verifications, so the memory stays small
+const maxRecentVerifications = 1000;
+
+// When set, every verification response takes at least this many
+// milliseconds, so response times don't reveal whether a phone has an
+// active code
+const minVerifyResponseInMs =
+  wholeNumberSetting('MIN_VERIFY_RESPONSE_MS', 1, 10 * 1000);
+
+// When set, verification attempts this many seconds or less after the code
+// was sent are rejected with 425: no human receives and types a code that
+// fast, so this discourages bots that send and immediately guess
+const minSecondsBeforeVerify =
+  wholeNumberSetting('MIN_SECONDS_BEFORE_VERIFY', 1, 60);
+
+// When set, each wrong guess for a code makes the next guess wait twice as
+// long as the last, starting at this many seconds (e.g. 1s, 2s, 4s). Guesses
+// made sooner are rejected with 429. This barely affects a person retyping a
+// code but makes brute force impractical.
+const wrongGuessBackoffInSeconds =
+  wholeNumberSetting('WRONG_GUESS_BACKOFF_SECONDS', 1, 60);
+
+// When set, a code is invalidated once this many verification calls have
+// been made for it, whether they were correct, wrong, empty or malformed.
+// Unlike a limit on wrong guesses, this stops scripts from probing the
+// endpoint's behaviour with an unlimited number of requests per code.
+const maxVerifyCallsPerCode = wholeNumberSetting('MAX_VERIFY_CALLS_PER_CODE');
+
+// When set, a code is invalidated after this many consecutive submissions
+// that aren't even numeric. People mistype digits; submitting letters or
+// symbols over and over strongly suggests a bot.
+const formatFailuresBeforeDelete =
+  wholeNumberSetting('FORMAT_FAILURES_BEFORE_DELETE');
+
+// When true, POST /otp/:phone_number only accepts JSON bodies and answers
+// 415 otherwise, which catches clients posting the wrong content type
+const requireJSONVerification =
+  process.env.REQUIRE_JSON_VERIFICATION === 'true';
+
+// Lets clients that can only make GET requests verify with
+// GET /otp/:phone_number/verify?code=... This is less secure than the POST
+// route, because the code ends up in URLs and access logs, so it is off
+// unless ALLOW_GET_VERIFICATION=true.
+const allowGetVerification = process.env.ALLOW_GET_VERIFICATION === 'true';
+if (allowGetVerification) {
+  console.log(
+    'WARNING: ALLOW_GET_VERIFICATION is enabled. Codes sent to ' +
+    'GET /otp/:phone_number/verify appear in URLs and logs.'
+  );
+}
+
+// When set, a successful verification answers 302 with this URL as its
+// Location instead of 200, for web flows that continue on another page. It
+// comes from the environment only, never from the request, so it can't be
+// turned into an open redirect.
+const verifySuccessRedirectURL =
+  process.env.VERIFY_SUCCESS_REDIRECT_URL || null;
+if (
+  verifySuccessRedirectURL != null &&
+  !/^https?:$/.test(URL.parse(verifySuccessRedirectURL)?.protocol)
+) {
+  console.log('VERIFY_SUCCESS_REDIRECT_URL must be an absolute http(s) URL.');
+  exit();
+}
+
+// When set, a successful verification also returns a proof signed with this
+// key (see proof.js), which other services holding the key can check
+// without calling this server
+const verificationSigningKey =
+  process.env.VERIFICATION_SIGNING_KEY || null;
+if (verificationSigningKey != null && verificationSigningKey.length < 32) {
+  console.log('VERIFICATION_SIGNING_KEY must be at least 32 characters.');
+  exit();
+}
+
+// Seconds between SIGTERM and closing the server, during which GET /readyz
+// answers 503 and new sends are turned away, so a load balancer can stop
+// routing to this instance before it goes
+const shutdownDelayInSeconds =
+  wholeNumberSetting('SHUTDOWN_DELAY_SECONDS', 0, 60) ?? 0;
+
 let activeCodes = {};
 
-function generateCode() {
-  // e.g. for code_length = 5, between 0 and 99999 (100000 - 1 = 10^5 - 1)
-  const rawCode = Math.floor(Math.random() * (10 ** codeLength));
-  // pad with leading zeroes, so e.g. 134 => 00134
-  return rawCode.toString().padStart(codeLength, '0');
+// set on SIGTERM
+let shuttingDown = false;
+
+// in-flight sends, so that sends to the same phone run one after another
+let pendingSends = {};
+
+// open /admin/logstream responses
+const logStreamClients = new Set();
+
+// recent successful verifications, oldest first, for answering retries
+const recentVerifications = new Map();
+
+let stats = {
+  sends: 0,
+  sendFailures: 0,
+  undeliveredCodes: 0,
+  verifySuccesses: 0,
+  verifyRetries: 0,
+  verifyFailures: {
+    noActiveCode: 0,
+    noCodeProvided: 0,
+    tooManyCalls: 0,
+    tooManyMalformed: 0,
+    sessionMismatch: 0,
+    unsupportedContentType: 0,
+    tooEarly: 0,
+    tooSoonAfterIncorrect: 0,
+    expired: 0,
+    incorrect: 0
+  }
+};
+
+// times of the sends made in the last minute, oldest first
+const recentSendTimes = [];
+
+// times of the sends to each phone in its quota window, oldest first, by
+// phone key, least recently sent-to phone first
+const recentSendTimesByPhone = new Map();
+
+// phones each client IP requested codes for in the current window, by IP,
+// least recently active IP first
+const recentPhonesByIP = new Map();
+
+// times of the failed sends in the current alert window, oldest first
+let recentSendFailureTimes = [];
+let lastSendFailureAlertTime = null;
+
+function phoneKey(phone) {
+  if (phoneKeySalt == null) {
+    return phone;
+  }
+  return crypto.createHash('sha256')
+    .update(phone + phoneKeySalt)
+    .digest('hex');
+}
+
+// the form a code is stored and compared in, see CODE_PEPPER
+function storedCode(phone, code) {
+  if (codePepper == null || typeof code !== 'string') {
+    return code;
+  }
+  return crypto.createHmac('sha256', codePepper)
+    .update(`${phone}:${code}`)
+    .digest('hex');
+}
+
+function maskPhone(phone) {
+  // keep the last 4 digits, e.g. 15551234567 => *******4567
+  return phone.slice(-4).padStart(phone.length, '*');
+}
+
+function logEvent(event, phone) {
+  if (analyticsLogFile == null && logStreamClients.size === 0) {
+    return;
+  }
+  // events carry masked phones only, never codes, wherever they are sent
+  const line = JSON.stringify({
+    event,
+    phone: maskPhone(phone),
+    timestamp: new Date().toISOString()
+  });
+  for (const client of logStreamClients) {
+    client.write(`data: ${line}\n\n`);
+  }
+  if (analyticsLogFile == null) {
+    return;
+  }
+  fs.appendFile(analyticsLogFile, `${line}\n`, (err) => {
+    if (err) {
+      console.log(`Could not write to ANALYTICS_LOG_FILE: ${err.message}`);
+    }
+  });
+}
+
+// Alerts SEND_FAILURE_ALERT_URL when too many sends fail. The alert is sent
+// in the background, so a slow or broken alert hook never affects the
+// request being handled.
+function recordSendFailure() {
+  if (sendFailureAlertURL == null) {
+    return;
+  }
+  const now = Date.now();
+  const windowInMs = sendFailureAlertWindowInSeconds * 1000;
+  recentSendFailureTimes =
+    recentSendFailureTimes.filter(time => now - time < windowInMs);
+  recentSendFailureTimes.push(now);
+  if (
+    recentSendFailureTimes.length < sendFailureAlertThreshold ||
+    (lastSendFailureAlertTime != null &&
+      now - lastSendFailureAlertTime < windowInMs)
+  ) {
+    return;
+  }
+
+  lastSendFailureAlertTime = now;
+  const text =
+    `WhatsApp OTP sample server: ${recentSendFailureTimes.length} sends ` +
+    `failed in the last ${sendFailureAlertWindowInSeconds}s ` +
+    `(${stats.sendFailures} since startup).`;
+  httpClient.post(sendFailureAlertURL, { text }, { timeout: 10 * 1000 })
+    .catch((error) => {
+      console.log(`Could not deliver send failure alert: ${error.message}`);
+    });
+}
+
+// Sliding window limit: drops the times that have left the window from the
+// front of times (oldest first). Returns null and records now if another
+// event fits in the window, or the seconds until one will otherwise.
+function slidingWindowRetryAfter(times, limit, windowInMs) {
+  const now = Date.now();
+  while (times.length > 0 && now - times[0] >= windowInMs) {
+    times.shift();
+  }
+  if (times.length >= limit) {
+    return Math.ceil((times[0] + windowInMs - now) / 1000);
+  }
+  times.push(now);
+  return null;
+}
+
+// Applies MAX_SENDS_PER_PHONE to a send to this phone, like
+// slidingWindowRetryAfter()
+function sendQuotaRetryAfter(key) {
+  const now = Date.now();
+  const windowInMs = sendQuotaWindowInSeconds * 1000;
+  // Phones are moved to the back when sent to, so phones whose whole
+  // quota window has passed are always at the front.
+  for (const [oldKey, times] of recentSendTimesByPhone) {
+    if (now - times[times.length - 1] < windowInMs) {
+      break;
+    }
+    recentSendTimesByPhone.delete(oldKey);
+  }
+
+  const times = recentSendTimesByPhone.get(key) ?? [];
+  const retryAfterInSeconds =
+    slidingWindowRetryAfter(times, maxSendsPerPhone, windowInMs);
+  if (retryAfterInSeconds == null) {
+    recentSendTimesByPhone.delete(key);
+    recentSendTimesByPhone.set(key, times);
+  }
+  return retryAfterInSeconds;
+}
+
+// Records that this IP requested a code for this phone. Returns null if that
+// is allowed, or the seconds until it will be if the IP already reached
+// MAX_PHONES_PER_IP other phones in the window.
+function checkPhonesPerIP(ip, key) {
+  const now = Date.now();
+  const windowInMs = phonesPerIPWindowInSeconds * 1000;
+  // IPs quiet for a whole window are forgotten. Active IPs are moved to the
+  // back, so the quiet ones are always at the front.
+  for (const [oldIP, { lastTime }] of recentPhonesByIP) {
+    if (now - lastTime < windowInMs) {
+      break;
+    }
+    recentPhonesByIP.delete(oldIP);
+  }
+
+  // phone keys with the time each was last requested, oldest first
+  const phones = recentPhonesByIP.get(ip)?.phones ?? new Map();
+  for (const [oldKey, time] of phones) {
+    if (now - time < windowInMs) {
+      break;
+    }
+    phones.delete(oldKey);
+  }
+  if (!phones.has(key) && phones.size >= maxPhonesPerIP) {
+    const [oldestTime] = phones.values();
+    return Math.ceil((oldestTime + windowInMs - now) / 1000);
+  }
+
+  phones.delete(key);
+  phones.set(key, now);
+  recentPhonesByIP.delete(ip);
+  recentPhonesByIP.set(ip, { phones, lastTime: now });
+  return null;
+}
+
+// Wraps message content in the envelope shared by every Cloud API message
+// type, e.g. buildMessage(phone, "text", { body }) puts the content under
+// "text"
+function buildMessage(phone, type, content) {
+  return {
+    messaging_product: "whatsapp",
+    recipient_type: "individual",
+    to: phone,
+    type,
+    [type]: content
+  };
 }
 
 let data;
 try {
   const filepath = new URL(`../setup/${filename}`, import.meta.url);
-  const rawData = fs.readFileSync(filepath);
+  const rawData = fs.readFileSync(filepath, 'utf8');
+  if (rawData.trim() === '') {
+    console.log(`The ${filename} file is empty. Please run setup.py again.`);
+    exit();
+  }
   data = JSON.parse(rawData);
 } catch (err) {
   if (err.code === 'ENOENT') {
@@ -41,70 +553,336 @@ try {
   throw (err);
 }
 
-const wabaID = data?.waba_id;
-assert(wabaID != null, `Missing WABA ID in ${filename} file.`);
-const accessToken = data?.access_token;
-assert(accessToken != null, `Missing access token in ${filename}.`);
-const phoneNumberID = data?.phone_number_id;
-assert(phoneNumberID != null, `Missing phone number ID in ${filename}`);
-const templateID = data?.template_id;
-assert(templateID != null, `Missing template ID in ${filename}.`);
+// A token file (e.g. a mounted Docker or Kubernetes secret) takes precedence
+// over the access token stored in the JSON file.
+const accessTokenFile = process.env.ACCESS_TOKEN_FILE;
+let fileAccessToken = null;
+if (accessTokenFile) {
+  try {
+    fileAccessToken = fs.readFileSync(accessTokenFile, 'utf8').trim();
+  } catch (err) {
+    console.log(
+      `Could not read ACCESS_TOKEN_FILE ${accessTokenFile}: ${err.message}`
+    );
+    exit();
+  }
+  if (fileAccessToken === '') {
+    console.log(`ACCESS_TOKEN_FILE ${accessTokenFile} is empty.`);
+    exit();
+  }
+}
+
+const configFields = {
+  waba_id: { label: "WABA ID", numeric: true },
+  access_token: {
+    label: "access token",
+    numeric: false,
+    optional: fileAccessToken != null
+  },
+  phone_number_id: { label: "phone number ID", numeric: true },
+  template_id: { label: "template ID", numeric: true, optional: true },
+  template_name: { label: "template name", numeric: false, optional: true }
+};
+
+// collect every problem with the file so they can all be fixed at once
+const configErrors = [];
+for (const key of Object.keys(data ?? {})) {
+  if (!(key in configFields)) {
+    configErrors.push(`Unknown field '${key}'.`);
+  }
+}
+for (
+  const [key, { label, numeric, optional }] of Object.entries(configFields)
+) {
+  const value = data?.[key];
+  if (value == null || value === '') {
+    if (!optional) {
+      configErrors.push(`Missing ${label}.`);
+    }
+  } else if (typeof value !== 'string') {
+    configErrors.push(`The ${label} must be a string.`);
+  } else if (numeric && !/^\d+$/.test(value)) {
+    configErrors.push(`The ${label} must only contain digits.`);
+  }
+}
+if (!data?.template_id && !data?.template_name) {
+  configErrors.push('Missing template ID (or template name).');
+}
+if (configErrors.length > 0) {
+  console.log(`Invalid ${filename} file:`);
+  configErrors.forEach(error => console.log(`  ${error}`));
+  console.log('Please fix the file or re-run setup.py.');
+  exit();
+}
+
+const wabaID = data.waba_id;
+const accessToken = fileAccessToken ?? data.access_token;
+const phoneNumberID = data.phone_number_id;
+// the template ID is authoritative; the name is only used to look the
+// template up when no ID is given, or cross-checked when both are
+const configuredTemplateID = data.template_id || null;
+const configuredTemplateName = data.template_name || null;
+const templateDescription = configuredTemplateID != null ?
+  `ID ${configuredTemplateID}` :
+  `name '${configuredTemplateName}'`;
+
+async function fetchGraphPage(url, description) {
+  for (let attempt = 1; ; attempt++) {
+    try {
+      return await httpClient.get(url);
+    } catch (error) {
+      const errorCode = error.response?.status;
+      const graphError = error.response?.data?.error;
+      console.log(
+        `Error (${errorCode}) while fetching ${description}: ` +
+        `${graphError?.message ?? error.message}`
+      );
+      const isTransient =
+        errorCode == null || errorCode === 429 || errorCode >= 500;
+      const delayInSeconds = 2 ** (attempt - 1);
+      const deadline = startupTime + startupFetchDeadlineInSeconds * 1000;
+      if (
+        isTransient && attempt < maxStartupFetchAttempts &&
+        Date.now() + delayInSeconds * 1000 <= deadline
+      ) {
+        console.log(
+          `Retrying in ${delayInSeconds}s (attempt ${attempt + 1} of ` +
+          `${maxStartupFetchAttempts})...`
+        );
+        await new Promise(
+          resolve => setTimeout(resolve, delayInSeconds * 1000)
+        );
+        continue;
+      }
+
+      if (errorCode === 401 || errorCode === 403 ||
+        graphError?.type === 'OAuthException') {
+        console.log(
+          `This looks like an authorization problem. Please check the ` +
+          `access token in ${accessTokenFile || filename} and the System ` +
+          `User's permissions (see README).`
+        );
+      } else if (isTransient) {
+        console.log(
+          'This looks like a network or Graph API problem. Please try again ' +
+          'later.'
+        );
+      }
+      exit();
+    }
+  }
+}
+
+let phoneNumbersURL =
+  `https://graph.facebook.com/${apiVersion}/${wabaID}/phone_numbers` +
+  `?access_token=${accessToken}`;
+let phoneNumber = null;
+let phoneNumberPages = 0;
+do {
+  const phoneNumbersResponse =
+    await fetchGraphPage(phoneNumbersURL, 'phone numbers');
+  phoneNumber = phoneNumbersResponse?.data?.data?.find(
+    phoneNumber => phoneNumber?.id === phoneNumberID
+  );
+  phoneNumbersURL = phoneNumbersResponse?.data?.paging?.next;
+  phoneNumberPages++;
+} while (
+  phoneNumber == null && phoneNumbersURL != null &&
+  phoneNumberPages < maxStartupPages
+);
+
+if (phoneNumber == null && phoneNumbersURL != null) {
+  console.log(
+    `Could not find phone number with ID ${phoneNumberID} for WABA ` +
+    `${wabaID} in the first ${maxStartupPages} pages of phone numbers. ` +
+    `Please verify the phone number ID in ${filename}.`
+  );
+  exit();
+} else if (phoneNumber == null) {
+  console.log(
+    `Could not find phone number with ID ${phoneNumberID} for WABA ` +
+    `${wabaID}. Please check the ${filename} file or re-run setup.py.`
+  );
+  exit();
+}
+
+// used to stop the business number from being sent a code by mistake
+const businessPhoneDigits =
+  phoneNumber?.display_phone_number?.replace(/\D/g, '');
 
 let templatesURL =
   `https://graph.facebook.com/${apiVersion}/${wabaID}/message_templates` +
   `?access_token=${accessToken}`;
 let template = null;
+let templatePages = 0;
 do {
-  const templatesResponse = await axios.get(templatesURL);
+  const templatesResponse =
+    await fetchGraphPage(templatesURL, 'message templates');
   template = templatesResponse?.data?.data?.find(
-    template => template?.id === templateID
+    template => configuredTemplateID != null ?
+      template?.id === configuredTemplateID :
+      template?.name === configuredTemplateName &&
+      template?.language === 'en_US'
   );
   templatesURL = templatesResponse?.data?.paging?.next;
-} while (template == null && templatesURL != null);
+  templatePages++;
+} while (
+  template == null && templatesURL != null && templatePages < maxStartupPages
+);
 
-if (template == null) {
+if (template == null && templatesURL != null) {
+  console.log(
+    `Could not find template with ${templateDescription} for WABA ` +
+    `${wabaID} in the first ${maxStartupPages} pages of templates. Please ` +
+    `verify the template in ${filename}.`
+  );
+  exit();
+} else if (template == null) {
+  console.log(
+    `Could not find template with ${templateDescription} for WABA ${wabaID}.`
+  );
+  exit();
+} else if (
+  configuredTemplateName != null && template?.name !== configuredTemplateName
+) {
   console.log(
-    `Could not find template with ID ${templateID} for WABA ${wabaID}.`
+    `Template with ID ${configuredTemplateID} is named '${template?.name}', ` +
+    `not '${configuredTemplateName}' as given in ${filename}.`
   );
   exit();
-} else if (template?.status !== 'APPROVED') {
+} else if (template?.status !== 'APPROVED' && sendMode === 'template') {
   console.log(
-    `Please wait until the template with ID ${templateID} is approved before ` +
-    `running this script.`
+    `Please wait until the template with ${templateDescription} is approved ` +
+    `before running this script.`
   );
   exit();
 }
 
+const templateID = template?.id;
 const templateName = template?.name;
-console.log(
-  `Verified OTP template '${templateName}' with ID ${templateID} is approved ` +
-  'and ready to send.'
-);
+if (sendMode === 'text') {
+  console.log(
+    `Found OTP template '${templateName}' with ID ${templateID} ` +
+    `(${template?.status}), but SEND_MODE is 'text', so codes are sent as ` +
+    'plain text messages.'
+  );
+} else {
+  console.log(
+    `Verified OTP template '${templateName}' with ID ${templateID} is ` +
+    'approved and ready to send.'
+  );
+}
 
-app.use(bodyParser.json());
+// keep the raw body as well, since webhook signatures are computed over it
+app.use(bodyParser.json({
+  verify: (req, _res, buf) => {
+    req.rawBody = buf;
+  }
+}));
+// simple web forms post the code as application/x-www-form-urlencoded
+app.use(bodyParser.urlencoded({ extended: false }));
 
 // Middleware that gets executed at the end of every request
 app.use((_req, res, next) => {
   console.log("Current time: ", new Date());
   res.on('finish', () => {
     console.log(`Response (${res.statusCode}): ${res.statusMessage}`);
-    console.log("Active codes state:")
-    console.table(activeCodes);
+    if (logActiveCodes) {
+      console.log("Active codes state:")
+      console.table(activeCodes);
+    }
     console.log()
   });
 
   next();
 })
 
-app.get('/otp/:phone_number', async (req, res) => {
-  const phone = req.params.phone_number;
-  console.log(`OTP requested for phone # ${phone}`);
+// Collapse repeated slashes so e.g. /otp//15551234567 still reaches the
+// OTP routes below
+app.use((req, _res, next) => {
+  req.url = req.url.replace(/^[^?]*/, path => path.replace(/\/{2,}/g, '/'));
+  next();
+});
 
-  const code = generateCode();
-  const expirationTimestamp = new Date();
-  expirationTimestamp.setMinutes(
-    expirationTimestamp.getMinutes() + codeLifetimeInMinutes
-  );
+// Express has already URL-decoded the parameter (so %2B is '+').
+// Normalizing it means "+1 (555) 123-4567" and "15551234567" refer to the
+// same active code.
+app.param('phone_number', (req, res, next, rawPhone) => {
+  const phone = normalizePhone(rawPhone);
+  if (phone == null) {
+    // not echoed back, as it is whatever the caller put in the URL
+    return res.status(400).send('Invalid phone number.');
+  }
+  req.phone = phone;
+  next();
+});
+
+// Meta support asks for these IDs when investigating delivery problems.
+// Lists only the ones the response has, or returns '' if it has none.
+function graphTraceInfo(response) {
+  const traceID = response?.headers?.['x-fb-trace-id'] ??
+    response?.data?.error?.fbtrace_id;
+  const requestID = response?.headers?.['x-fb-request-id'];
+  const usage = response?.headers?.['x-business-use-case-usage'];
+  return [
+    ['trace ID', traceID],
+    ['request ID', requestID],
+    ['usage', usage]
+  ].filter(([, value]) => value != null)
+    .map(([label, value]) => `${label}: ${value}`)
+    .join(', ');
+}
+
+async function sendCode(phone, sessionID, maxVerifyCalls, res) {
+  const key = phoneKey(phone);
+  const existingCode = activeCodes[key];
+  const hasValidCode = existingCode != null &&
+    existingCode.expirationTimestamp.getTime() > Date.now();
+  if (hasValidCode && existingCodePolicy === 'reject') {
+    const retryAfterInSeconds = Math.ceil(
+      (existingCode.expirationTimestamp.getTime() - Date.now()) / 1000
+    );
+    res.set('Retry-After', retryAfterInSeconds.toString());
+    return res.status(429).send(
+      'A code was already sent to this phone number, please use it or try ' +
+      'again later.'
+    );
+  }
+
+  if (maxSendsPerPhone != null) {
+    const retryAfterInSeconds = sendQuotaRetryAfter(key);
+    if (retryAfterInSeconds != null) {
+      res.set('Retry-After', retryAfterInSeconds.toString());
+      return res.status(429).send(
+        'Too many codes sent to this phone number, please use the last one ' +
+        'or try again later.'
+      );
+    }
+  }
+
+  if (maxSendsPerMinute != null) {
+    const retryAfterInSeconds = slidingWindowRetryAfter(
+      recentSendTimes, maxSendsPerMinute, 60 * 1000
+    );
+    if (retryAfterInSeconds != null) {
+      res.set('Retry-After', retryAfterInSeconds.toString());
+      return res.status(429).send(
+        'Too many codes sent in the last minute, please try again later.'
+      );
+    }
+  }
+
+  // a reused code is sent as-is, keeping its original expiry
+  const reusedCode =
+    hasValidCode && existingCodePolicy === 'reuse' ? existingCode : null;
+  const code = reusedCode?.code ?? generateCode(codeLength);
+  let expirationTimestamp = reusedCode?.expirationTimestamp;
+  if (expirationTimestamp == null) {
+    expirationTimestamp = new Date();
+    expirationTimestamp.setMinutes(
+      expirationTimestamp.getMinutes() + codeLifetimeInMinutes
+    );
+  }
 
   const sendMessageURL =
     `https://graph.facebook.com/${apiVersion}/${phoneNumberID}/messages`;
@@ -113,12 +891,20 @@ app.get('/otp/:phone_number', async (req, res) => {
       Authorization: `Bearer ${accessToken}`
     }
   };
-  const payload = {
-    messaging_product: "whatsapp",
-    recipient_type: "individual",
-    to: phone,
-    type: "template",
-    template: {
+  let payload;
+  if (sendMode === 'text') {
+    // templates render the expiry themselves, but a text message has to say
+    // it; a reused code may have less than the full lifetime left
+    const minutesLeft = Math.max(
+      1, Math.ceil((expirationTimestamp.getTime() - Date.now()) / (60 * 1000))
+    );
+    const minutesText =
+      minutesLeft === 1 ? '1 minute' : `${minutesLeft} minutes`;
+    payload = buildMessage(phone, "text", {
+      body: `${code} is your verification code. It expires in ${minutesText}.`
+    });
+  } else {
+    payload = buildMessage(phone, "template", {
       name: templateName,
       language: {
         code: "en_US"
@@ -145,44 +931,421 @@ app.get('/otp/:phone_number', async (req, res) => {
           ]
         }
       ]
-    }
-  };
+    });
+  }
 
-  await axios.post(sendMessageURL, payload, config).then((_res) => {
-    activeCodes[phone] = { code, expirationTimestamp };
-    res.send();
+  await httpClient.post(sendMessageURL, payload, config).then((response) => {
+    const traceInfo = graphTraceInfo(response);
+    console.log(`Sent OTP message${traceInfo ? ` (${traceInfo})` : ''}`);
+    // a reused code is stored again only to record when it was last sent
+    activeCodes[key] = {
+      code: storedCode(phone, code),
+      expirationTimestamp,
+      sentTimestamp: new Date(),
+      attempts: reusedCode?.attempts ?? 0,
+      verifyCalls: reusedCode?.verifyCalls ?? 0,
+      maxVerifyCalls,
+      formatFailures: reusedCode?.formatFailures ?? 0,
+      nextGuessTimestamp: reusedCode?.nextGuessTimestamp ?? null,
+      sessionID,
+      // the message this code was last sent in, for delivery webhooks
+      messageID: response.data?.messages?.[0]?.id,
+      deliveryStatus: null
+    };
+    recentVerifications.delete(key);
+    stats.sends++;
+    logEvent('sent', phone);
+    if (sendSuccessStatus === 202) {
+      res.status(202).json({ message_id: response.data?.messages?.[0]?.id });
+    } else {
+      res.send();
+    }
   }).catch((error) => {
     const errorCode = error.response?.status;
     const errorText = error.response?.data?.error?.error_data?.details;
     console.log(`Error (${errorCode}) from calling send message API: ${errorText}`);
+    const traceInfo = graphTraceInfo(error.response);
+    if (traceInfo) {
+      console.log(`(${traceInfo})`);
+    }
+    stats.sendFailures++;
+    recordSendFailure();
+    logEvent('send_failed', phone);
 
+    if (uniformSendResponse) {
+      console.log('Answering 200 anyway, as UNIFORM_SEND_RESPONSE is set.');
+      return res.send();
+    }
     res.status(500).send('Error calling send message API. Check server logs.');
   });
+}
+
+// Asks the CAPTCHA provider whether the token is valid. Returns true or
+// false, or null if the provider could not be reached.
+async function checkCaptchaToken(token, ip) {
+  const form = new URLSearchParams({
+    secret: captchaSecret,
+    response: token,
+    remoteip: ip
+  });
+  try {
+    const response = await httpClient.post(captchaVerifyURL, form);
+    return response.data?.success === true;
+  } catch (error) {
+    console.log(`Could not check CAPTCHA token: ${error.message}`);
+    return null;
+  }
+}
+
+app.all('/otp', (_req, res) => {
+  res.status(400).send("No phone number provided.");
 });
 
-app.post('/otp/:phone_number', (req, res) => {
-  const phone = req.params.phone_number;
-  console.log(`OTP validation request for phone # ${phone}`);
+app.get('/otp/:phone_number', async (req, res) => {
+  const phone = req.phone;
+  console.log(`OTP requested for phone # ${phone}`);
+
+  if (shuttingDown) {
+    return res.status(503).send('Server is shutting down, please try again.');
+  }
+
+  // req.phone is already normalized to digits by app.param
+  if (phone === businessPhoneDigits) {
+    return res.status(400).send(
+      "Cannot send a code to the business's own phone number."
+    );
+  }
+
+  if (
+    sandboxAllowedPhones != null &&
+    !sandboxAllowedPhones.has(phone)
+  ) {
+    return res.status(403).send(
+      'This phone number is not in SANDBOX_ALLOWED_PHONES.'
+    );
+  }
+
+  if (captchaVerifyURL != null) {
+    const token = req.get('X-Captcha-Token');
+    const valid = token ? await checkCaptchaToken(token, req.ip) : false;
+    if (valid == null) {
+      return res.status(503).send(
+        'Could not check the CAPTCHA token, please try again later.'
+      );
+    } else if (!valid) {
+      return res.status(403).send('Missing or invalid CAPTCHA token.');
+    }
+  }
 
-  const { code: expectedCode, expirationTimestamp } = activeCodes[phone];
-  if (expectedCode == null) {
-    return res.status(404).send(`No active code for phone # ${phone}`);
+  if (maxPhonesPerIP != null) {
+    const retryAfterInSeconds = checkPhonesPerIP(req.ip, phoneKey(phone));
+    if (retryAfterInSeconds != null) {
+      res.set('Retry-After', retryAfterInSeconds.toString());
+      return res.status(429).send(
+        'Too many different phone numbers requested from this address, ' +
+        'please try again later.'
+      );
+    }
   }
 
-  const actualCode = req.body?.code;
-  if (actualCode == null) {
-    return res.status(400).send("No code provided.");
-  } else if (expirationTimestamp < Date.now()) {
-    delete activeCodes[phone];
-    return res.status(401).send("Code has expired, please request another.");
-  } else if (actualCode !== expectedCode) {
-    return res.status(401).send("Incorrect code.");
+  // A client may bind the code to its session by sending an opaque ID with
+  // both requests, so that a code intercepted elsewhere is useless
+  const sessionID = req.get('X-Session-ID') || null;
+
+  // High-value flows may allow fewer verification calls for their code than
+  // MAX_VERIFY_CALLS_PER_CODE, but never more
+  let maxVerifyCalls = maxVerifyCallsPerCode;
+  const rawMaxVerifyCalls = req.query.max_verify_calls;
+  if (rawMaxVerifyCalls != null) {
+    const limit = maxVerifyCallsPerCode ?? Number.MAX_SAFE_INTEGER;
+    maxVerifyCalls = Number(rawMaxVerifyCalls);
+    if (
+      !/^\d+$/.test(rawMaxVerifyCalls) ||
+      maxVerifyCalls < 1 || maxVerifyCalls > limit
+    ) {
+      return res.status(400).send(
+        `max_verify_calls must be a whole number between 1 and ${limit}.`
+      );
+    }
+  }
+
+  await runInTurn(
+    pendingSends, phone,
+    () => sendCode(phone, sessionID, maxVerifyCalls, res)
+  );
+});
+
+const verifyCode = createVerifier({
+  activeCodes,
+  recentVerifications,
+  stats,
+  phoneKey,
+  storedCode,
+  logEvent,
+  // the user has proven they own the phone, so its send quota starts over
+  onVerified: (key) => recentSendTimesByPhone.delete(key),
+  codeLifetimeInMinutes,
+  expiryGraceInSeconds,
+  clockSkewInSeconds,
+  verifyRetryWindowInSeconds,
+  maxRecentVerifications,
+  minSecondsBeforeVerify,
+  wrongGuessBackoffInSeconds,
+  formatFailuresBeforeDelete,
+  verificationSigningKey
+});
+
+// Sends a verification response, first waiting out the rest of the minimum
+// response time (if any) so that every outcome takes about as long
+async function sendVerifyResponse(
+  res, startTime, { status, body, nextAction, retryAfterInSeconds }
+) {
+  if (minVerifyResponseInMs != null) {
+    const remainingInMs = startTime + minVerifyResponseInMs - Date.now();
+    if (remainingInMs > 0) {
+      await new Promise(resolve => setTimeout(resolve, remainingInMs));
+    }
+  }
+  if (status === 200 && verifySuccessRedirectURL != null) {
+    return res.redirect(302, verifySuccessRedirectURL);
+  }
+  if (nextAction != null) {
+    res.set('Next-Action', nextAction);
+  }
+  if (retryAfterInSeconds != null) {
+    res.set('Retry-After', retryAfterInSeconds.toString());
+  }
+  res.status(status).send(body);
+}
+
+app.post('/otp/:phone_number', async (req, res) => {
+  const startTime = Date.now();
+  if (requireJSONVerification && !req.is('application/json')) {
+    stats.verifyFailures.unsupportedContentType++;
+    return sendVerifyResponse(res, startTime, {
+      status: 415,
+      body: "Content-Type must be application/json.",
+      nextAction: 'CONTACT_SUPPORT'
+    });
+  }
+  await sendVerifyResponse(
+    res,
+    startTime,
+    verifyCode(req.phone, req.body?.code, req.get('X-Session-ID'))
+  );
+});
+
+if (allowGetVerification) {
+  app.get('/otp/:phone_number/verify', async (req, res) => {
+    const startTime = Date.now();
+    await sendVerifyResponse(
+      res,
+      startTime,
+      verifyCode(req.phone, req.query.code, req.get('X-Session-ID'))
+    );
+  });
+}
+
+if (logStreamToken != null) {
+  // compare digests, so that the comparison takes the same time whatever
+  // the submitted token
+  const tokenDigest = (token) =>
+    crypto.createHash('sha256').update(token).digest();
+  const expectedTokenDigest = tokenDigest(`Bearer ${logStreamToken}`);
+
+  app.get('/admin/logstream', (req, res) => {
+    const authorization = req.get('Authorization') ?? '';
+    if (
+      !crypto.timingSafeEqual(tokenDigest(authorization), expectedTokenDigest)
+    ) {
+      return res.status(401).send('Missing or incorrect LOG_STREAM_TOKEN.');
+    }
+    res.set({
+      'Content-Type': 'text/event-stream',
+      'Cache-Control': 'no-cache',
+      Connection: 'keep-alive'
+    });
+    res.flushHeaders();
+    logStreamClients.add(res);
+    req.on('close', () => logStreamClients.delete(res));
+  });
+}
+
+if (webhookVerifyToken != null) {
+  app.get('/webhook', (req, res) => {
+    if (
+      req.query['hub.mode'] !== 'subscribe' ||
+      req.query['hub.verify_token'] !== webhookVerifyToken
+    ) {
+      return res.status(403).send('Incorrect WEBHOOK_VERIFY_TOKEN.');
+    }
+    res.type('text/plain').send(req.query['hub.challenge']);
+  });
+
+  app.post('/webhook', (req, res) => {
+    const signature = Buffer.from(req.get('X-Hub-Signature-256') ?? '');
+    const expectedSignature = Buffer.from('sha256=' + crypto
+      .createHmac('sha256', webhookAppSecret)
+      .update(req.rawBody ?? '')
+      .digest('hex'));
+    if (
+      signature.length !== expectedSignature.length ||
+      !crypto.timingSafeEqual(signature, expectedSignature)
+    ) {
+      return res.status(401).send('Missing or invalid X-Hub-Signature-256.');
+    }
+    for (const entry of req.body?.entry ?? []) {
+      for (const change of entry.changes ?? []) {
+        for (const status of change.value?.statuses ?? []) {
+          recordDeliveryStatus(status.id, status.status, status.recipient_id);
+        }
+      }
+    }
+    // anything but 200 makes Meta send the webhook again
+    res.send();
+  });
+}
+
+// statuses in the order WhatsApp reports them for a delivered message
+const deliveryStatuses = ['sent', 'delivered', 'read'];
+
+// Applies a status webhook to the active code sent in the given message, if
+// it is still the phone's current code: a failed message deletes the code,
+// other statuses are recorded for GET /otp/:phone_number/delivery. Codes are
+// keyed by phone (or its hash), so this looks through all of them.
+function recordDeliveryStatus(messageID, status, phone) {
+  for (const [key, activeCode] of Object.entries(activeCodes)) {
+    if (activeCode.messageID !== messageID) {
+      continue;
+    }
+    if (status === 'failed') {
+      delete activeCodes[key];
+      stats.undeliveredCodes++;
+      console.log(`OTP message to phone # ${phone} failed to deliver`);
+      logEvent('undelivered', phone);
+    } else if (
+      // webhooks can arrive out of order, e.g. 'read' before 'delivered'
+      deliveryStatuses.indexOf(status) >
+      deliveryStatuses.indexOf(activeCode.deliveryStatus)
+    ) {
+      activeCode.deliveryStatus = status;
+    }
+    return;
   }
+}
 
-  delete activeCodes[phone];
-  res.send();
+// Lets clients show whether the code's message has arrived, as reported by
+// the delivery webhook: 'sent', 'delivered', 'read' or 'unknown'. A code
+// bound to a session only reports its status to that session.
+app.get('/otp/:phone_number/delivery', (req, res) => {
+  const activeCode = activeCodes[phoneKey(req.phone)];
+  const visible = activeCode != null && (
+    activeCode.sessionID == null ||
+    activeCode.sessionID === req.get('X-Session-ID')
+  );
+  res.json({ status: (visible && activeCode.deliveryStatus) || 'unknown' });
 });
 
-app.listen(port, () => {
+function currentStats() {
+  return { ...stats, activeCodes: Object.keys(activeCodes).length };
+}
+
+app.get('/stats', (_req, res) => {
+  res.json(currentStats());
+});
+
+// Lists the approved templates codes are sent with, by name and language
+// only, for clients that offer a choice of flows. There is exactly one,
+// whose approval was checked at startup, or none in text mode.
+app.get('/templates', (_req, res) => {
+  res.json(
+    sendMode === 'template' ? [{ name: templateName, language: 'en_US' }] : []
+  );
+});
+
+app.get('/readyz', (_req, res) => {
+  res.status(shuttingDown ? 503 : 200).send();
+});
+
+if (statsLogIntervalInSeconds != null) {
+  // unref() so the timer never keeps the process alive on its own
+  setInterval(() => {
+    console.log('Stats snapshot:', JSON.stringify(currentStats()));
+  }, statsLogIntervalInSeconds * 1000).unref();
+}
+
+const server = app.listen(port, () => {
+  // Secrets are only reported as set ('****') or not (null). Phone numbers
+  // are masked like everywhere else in the logs.
+  const redacted = (value) => value != null ? '****' : null;
+  console.log('Effective configuration:', JSON.stringify({
+    port,
+    apiVersion,
+    userAgent,
+    codeLength,
+    codeLifetimeInMinutes,
+    logActiveCodes,
+    maxStartupFetchAttempts,
+    startupFetchDeadlineInSeconds,
+    maxStartupPages,
+    phoneKeySalt: redacted(phoneKeySalt),
+    codePepper: redacted(codePepper),
+    existingCodePolicy,
+    sendMode,
+    sendSuccessStatus,
+    uniformSendResponse,
+    maxSendsPerMinute,
+    maxSendsPerPhone,
+    sendQuotaWindowInSeconds,
+    maxPhonesPerIP,
+    phonesPerIPWindowInSeconds,
+    sendFailureAlertURL: redacted(sendFailureAlertURL),
+    sendFailureAlertThreshold,
+    sendFailureAlertWindowInSeconds,
+    captchaVerifyURL,
+    captchaSecret: redacted(captchaSecret),
+    webhookVerifyToken: redacted(webhookVerifyToken),
+    webhookAppSecret: redacted(webhookAppSecret),
+    sandboxAllowedPhones: sandboxAllowedPhones != null
+      ? [...sandboxAllowedPhones].map(maskPhone)
+      : null,
+    expiryGraceInSeconds,
+    clockSkewInSeconds,
+    analyticsLogFile,
+    logStreamToken: redacted(logStreamToken),
+    statsLogIntervalInSeconds,
+    verifyRetryWindowInSeconds,
+    minVerifyResponseInMs,
+    minSecondsBeforeVerify,
+    wrongGuessBackoffInSeconds,
+    maxVerifyCallsPerCode,
+    formatFailuresBeforeDelete,
+    requireJSONVerification,
+    allowGetVerification,
+    verifySuccessRedirectURL,
+    verificationSigningKey: redacted(verificationSigningKey),
+    shutdownDelayInSeconds,
+    wabaID,
+    phoneNumberID,
+    templateID,
+    templateName,
+    accessTokenFile: accessTokenFile || null,
+    accessToken: '****'
+  }));
   console.log(`Sample app listening on port ${port}`);
 });
+
+// Kubernetes sends SIGTERM at the start of a rolling update. In-flight
+// requests are allowed to finish, but active codes only live in memory and
+// are lost, so users mid-verification have to request a new code.
+process.once('SIGTERM', () => {
+  console.log(`SIGTERM received, closing in ${shutdownDelayInSeconds}s`);
+  shuttingDown = true;
+  setTimeout(() => {
+    // log streams never end on their own and would keep the server open
+    for (const client of logStreamClients) {
+      client.end();
+    }
+    server.close(() => exit());
+  }, shutdownDelayInSeconds * 1000);
+});
@@ -0,0 +1,265 @@
+// The parts of the OTP flow that don't touch the network or the file
+// system, so that they can be tested without starting the server. app.js
+// wires them up with its settings and in-memory state.
+import process from 'process';
+import { signProof } from './proof.js';
+
+// Reads an optional whole-number setting from the environment. Returns null
+// when it is unset and exits with a clear message when it is out of range.
+export function wholeNumberSetting(
+  name, min = 1, max = Number.MAX_SAFE_INTEGER
+) {
+  const rawValue = process.env[name];
+  if (rawValue == null || rawValue === '') {
+    return null;
+  }
+  const value = Number(rawValue);
+  if (!/^\d+$/.test(rawValue) || value < min || value > max) {
+    console.log(`${name} must be a whole number between ${min} and ${max}.`);
+    process.exit();
+  }
+  return value;
+}
+
+// random can be swapped for a fixed source, so tests get known codes while
+// still exercising the range and padding below
+export function generateCode(codeLength, random = Math.random) {
+  // e.g. for code_length = 5, between 0 and 99999 (100000 - 1 = 10^5 - 1)
+  const rawCode = Math.floor(random() * (10 ** codeLength));
+  // pad with leading zeroes, so e.g. 134 => 00134
+  return rawCode.toString().padStart(codeLength, '0');
+}
+
+export function normalizePhone(phone) {
+  // strip the usual formatting characters, so e.g. "+1 (555) 123-4567" and
+  // "15551234567" are the same phone; null if anything but digits remains
+  const digits = phone.replace(/[\s+\-().]/g, '');
+  return /^\d+$/.test(digits) ? digits : null;
+}
+
+export function normalizeCode(code) {
+  // strip whitespace and separators users may paste along with the code,
+  // e.g. " 123-45 " => "12345"
+  return typeof code === 'string' ? code.replace(/[\s\-.]/g, '') : code;
+}
+
+// Runs task once every task queued before it under the same key has
+// settled, and returns its result. queues maps each key to its last queued
+// task and is cleaned up as they finish. If two sends for the same phone
+// overlapped, whichever API call finished last would win, so the stored
+// code might not be the one in the last message sent.
+export async function runInTurn(queues, key, task) {
+  const previous = queues[key] ?? Promise.resolve();
+  const current = previous.catch(() => {}).then(task);
+  queues[key] = current;
+  try {
+    return await current;
+  } finally {
+    if (queues[key] === current) {
+      delete queues[key];
+    }
+  }
+}
+
+// Returns verifyCode(phone, submittedCode, submittedSessionID), which checks
+// a submitted code against activeCodes and returns the response to send, as
+// { status, body }, plus a nextAction hint for failures: RETRY (submit a
+// code again), RESEND (request a new code), WAIT (try the same code later)
+// or CONTACT_SUPPORT (the client itself is at fault). A 429 also has
+// retryAfterInSeconds.
+//
+// The settings are the ones app.js reads from the environment, with null
+// meaning unset. phoneKey and storedCode give the form phones and codes are
+// stored in, logEvent reports events, and onVerified(key) is called after
+// each successful verification.
+export function createVerifier({
+  activeCodes,
+  recentVerifications,
+  stats,
+  phoneKey = (phone) => phone,
+  storedCode = (_phone, code) => code,
+  logEvent = () => {},
+  onVerified = () => {},
+  codeLifetimeInMinutes,
+  expiryGraceInSeconds = 0,
+  clockSkewInSeconds = 0,
+  verifyRetryWindowInSeconds = null,
+  maxRecentVerifications = 1000,
+  minSecondsBeforeVerify = null,
+  wrongGuessBackoffInSeconds = null,
+  formatFailuresBeforeDelete = null,
+  verificationSigningKey = null
+}) {
+  function rememberVerification(key, code, body) {
+    if (verifyRetryWindowInSeconds == null) {
+      return;
+    }
+    const now = Date.now();
+    recentVerifications.delete(key);
+    recentVerifications.set(key, {
+      code,
+      body,
+      expirationTime: now + verifyRetryWindowInSeconds * 1000
+    });
+    // Entries share one window, so the oldest expire first. Drop those, and
+    // then the oldest live ones if there are still too many.
+    for (const [oldKey, { expirationTime }] of recentVerifications) {
+      if (
+        expirationTime > now &&
+        recentVerifications.size <= maxRecentVerifications
+      ) {
+        break;
+      }
+      recentVerifications.delete(oldKey);
+    }
+  }
+
+  return function verifyCode(phone, submittedCode, submittedSessionID) {
+    console.log(`OTP validation request for phone # ${phone}`);
+
+    const key = phoneKey(phone);
+    const {
+      code: expectedCode,
+      expirationTimestamp,
+      sentTimestamp,
+      attempts,
+      nextGuessTimestamp,
+      sessionID
+    } = activeCodes[key] ?? {};
+    const actualCode = normalizeCode(submittedCode);
+    if (expectedCode == null) {
+      const recent = recentVerifications.get(key);
+      if (
+        recent != null && recent.expirationTime > Date.now() &&
+        recent.code === storedCode(phone, actualCode)
+      ) {
+        // a retry of a verification that already succeeded
+        stats.verifyRetries++;
+        return { status: 200, body: recent.body };
+      }
+      stats.verifyFailures.noActiveCode++;
+      return {
+        status: 404,
+        body: `No active code for phone # ${phone}`,
+        nextAction: 'RESEND'
+      };
+    }
+
+    activeCodes[key].verifyCalls++;
+    if (
+      activeCodes[key].maxVerifyCalls != null &&
+      activeCodes[key].verifyCalls > activeCodes[key].maxVerifyCalls
+    ) {
+      delete activeCodes[key];
+      stats.verifyFailures.tooManyCalls++;
+      logEvent('verify_failed', phone);
+      return {
+        status: 401,
+        body: "Too many verification attempts, please request another code.",
+        nextAction: 'RESEND'
+      };
+    }
+
+    // expiry as seen by this server, allowing for clock drift
+    const skewedExpiration =
+      expirationTimestamp.getTime() + clockSkewInSeconds * 1000;
+    if (actualCode == null || actualCode === '') {
+      stats.verifyFailures.noCodeProvided++;
+      return { status: 400, body: "No code provided.", nextAction: 'RETRY' };
+    } else if (sessionID != null && submittedSessionID !== sessionID) {
+      stats.verifyFailures.sessionMismatch++;
+      return {
+        status: 403,
+        body: "This code was requested from another session.",
+        nextAction: 'RESEND'
+      };
+    } else if (
+      minSecondsBeforeVerify != null &&
+      Date.now() - sentTimestamp.getTime() <= minSecondsBeforeVerify * 1000
+    ) {
+      stats.verifyFailures.tooEarly++;
+      return {
+        status: 425,
+        body: "Code submitted too soon after it was sent, please try again.",
+        nextAction: 'WAIT'
+      };
+    } else if (skewedExpiration + expiryGraceInSeconds * 1000 < Date.now()) {
+      delete activeCodes[key];
+      stats.verifyFailures.expired++;
+      logEvent('expired', phone);
+      return {
+        status: 401,
+        body: "Code has expired, please request another.",
+        nextAction: 'RESEND'
+      };
+    } else if (
+      nextGuessTimestamp != null && nextGuessTimestamp.getTime() > Date.now()
+    ) {
+      // even a correct code waits, or the backoff would tell bots nothing
+      stats.verifyFailures.tooSoonAfterIncorrect++;
+      return {
+        status: 429,
+        body: "Too many incorrect codes, please wait before trying again.",
+        nextAction: 'WAIT',
+        retryAfterInSeconds:
+          Math.ceil((nextGuessTimestamp.getTime() - Date.now()) / 1000)
+      };
+    } else if (storedCode(phone, actualCode) !== expectedCode) {
+      activeCodes[key].attempts++;
+      if (wrongGuessBackoffInSeconds != null) {
+        // capped at the code lifetime, which no backoff needs to exceed
+        const backoffInSeconds = Math.min(
+          wrongGuessBackoffInSeconds * 2 ** (activeCodes[key].attempts - 1),
+          codeLifetimeInMinutes * 60
+        );
+        activeCodes[key].nextGuessTimestamp =
+          new Date(Date.now() + backoffInSeconds * 1000);
+      }
+      // only consecutive malformed submissions count, so a bot can't hide
+      // behind the odd well-formed guess
+      if (/^\d+$/.test(actualCode)) {
+        activeCodes[key].formatFailures = 0;
+      } else {
+        activeCodes[key].formatFailures++;
+      }
+      if (
+        formatFailuresBeforeDelete != null &&
+        activeCodes[key].formatFailures >= formatFailuresBeforeDelete
+      ) {
+        delete activeCodes[key];
+        stats.verifyFailures.tooManyMalformed++;
+        logEvent('verify_failed', phone);
+        return {
+          status: 401,
+          body: "Too many malformed codes, please request another code.",
+          nextAction: 'RESEND'
+        };
+      }
+      stats.verifyFailures.incorrect++;
+      logEvent('verify_failed', phone);
+      return { status: 401, body: "Incorrect code.", nextAction: 'RETRY' };
+    }
+
+    delete activeCodes[key];
+    onVerified(key);
+    stats.verifySuccesses++;
+    logEvent('verified', phone);
+    // attempt_number counts from 1 for a first-time success, to help measure
+    // how often users mistype codes. verified_at is an RFC 3339 timestamp
+    // for receipts; a retry gets the original one back.
+    const verifiedAt = new Date();
+    const body = {
+      attempt_number: attempts + 1,
+      verified_at: verifiedAt.toISOString()
+    };
+    if (verificationSigningKey != null) {
+      body.proof = signProof(verificationSigningKey, phone, verifiedAt);
+    }
+    // a late success is only possible within the grace period
+    if (skewedExpiration < Date.now()) {
+      body.grace = true;
+    }
+    rememberVerification(key, expectedCode, body);
+    return { status: 200, body };
+  };
+}
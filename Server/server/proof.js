@@ -0,0 +1,56 @@
+import crypto from 'crypto';
+
+// A verification proof is the compact string
+//
+//   <phone hash>.<timestamp>.<signature>
+//
+// where the phone hash is the base64url SHA-256 of the phone number's
+// digits, the timestamp is the verification time in whole seconds since the
+// Unix epoch, and the signature is the base64url HMAC-SHA256 of
+// "<phone hash>.<timestamp>" under the signing key. Services holding the key
+// can check a proof offline, without calling the OTP server.
+
+function phoneHash(phone) {
+  return crypto.createHash('sha256').update(phone).digest('base64url');
+}
+
+function signature(signingKey, payload) {
+  return crypto.createHmac('sha256', signingKey)
+    .update(payload)
+    .digest('base64url');
+}
+
+export function signProof(signingKey, phone, verifiedAt = new Date()) {
+  const payload =
+    `${phoneHash(phone)}.${Math.floor(verifiedAt.getTime() / 1000)}`;
+  return `${payload}.${signature(signingKey, payload)}`;
+}
+
+// Returns the time the proof was issued as a Date, or null if it is
+// malformed, not signed with signingKey, for another phone, or older than
+// maxAgeInSeconds. The phone must be in the same digits-only form the server
+// uses, e.g. 15551234567.
+export function verifyProof(signingKey, proof, phone, maxAgeInSeconds) {
+  const parts = typeof proof === 'string' ? proof.split('.') : [];
+  if (parts.length !== 3 || !/^\d+$/.test(parts[1])) {
+    return null;
+  }
+  const [hash, timestamp, submittedSignature] = parts;
+  const actual = Buffer.from(submittedSignature);
+  const expected = Buffer.from(signature(signingKey, `${hash}.${timestamp}`));
+  if (
+    actual.length !== expected.length ||
+    !crypto.timingSafeEqual(actual, expected) ||
+    hash !== phoneHash(phone)
+  ) {
+    return null;
+  }
+  const issuedAt = new Date(Number(timestamp) * 1000);
+  if (
+    maxAgeInSeconds != null &&
+    Date.now() - issuedAt.getTime() > maxAgeInSeconds * 1000
+  ) {
+    return null;
+  }
+  return issuedAt;
+}
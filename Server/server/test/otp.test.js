@@ -0,0 +1,404 @@
+import assert from 'node:assert/strict';
+import crypto from 'node:crypto';
+import { afterEach, beforeEach, describe, mock, test } from 'node:test';
+import {
+  createVerifier,
+  generateCode,
+  normalizeCode,
+  normalizePhone,
+  runInTurn,
+  wholeNumberSetting
+} from '../otp.js';
+import { verifyProof } from '../proof.js';
+
+const phone = '15551234567';
+
+beforeEach(() => {
+  mock.method(console, 'log', () => {});
+  mock.timers.enable({ apis: ['Date'], now: Date.UTC(2024, 0, 1) });
+});
+
+afterEach(() => {
+  mock.timers.reset();
+  mock.restoreAll();
+});
+
+describe('normalizePhone', () => {
+  test('strips formatting characters', () => {
+    assert.equal(normalizePhone('+1 (555) 123-4567'), phone);
+    assert.equal(normalizePhone('1.555.123.4567'), phone);
+  });
+
+  test('rejects anything else', () => {
+    assert.equal(normalizePhone('1555CALLNOW'), null);
+    assert.equal(normalizePhone(''), null);
+  });
+});
+
+describe('normalizeCode', () => {
+  test('strips whitespace and separators', () => {
+    assert.equal(normalizeCode(' 123-45 '), '12345');
+    assert.equal(normalizeCode('1 2.3 4 5'), '12345');
+  });
+
+  test('leaves other values alone', () => {
+    assert.equal(normalizeCode(undefined), undefined);
+    assert.equal(normalizeCode(12345), 12345);
+  });
+});
+
+describe('generateCode', () => {
+  test('pads with leading zeroes', () => {
+    assert.equal(generateCode(5, () => 0), '00000');
+    assert.equal(generateCode(5, () => 0.00134), '00134');
+  });
+
+  test('stays within the code length', () => {
+    assert.equal(generateCode(5, () => 0.999999999), '99999');
+    assert.equal(generateCode(6, () => 0.5), '500000');
+  });
+});
+
+describe('wholeNumberSetting', () => {
+  const name = 'OTP_TEST_SETTING';
+
+  beforeEach(() => {
+    mock.method(process, 'exit', () => {
+      throw new Error('exit');
+    });
+  });
+
+  afterEach(() => {
+    delete process.env[name];
+  });
+
+  test('is null when unset or empty', () => {
+    assert.equal(wholeNumberSetting(name), null);
+    process.env[name] = '';
+    assert.equal(wholeNumberSetting(name), null);
+  });
+
+  test('reads whole numbers within range', () => {
+    process.env[name] = '0';
+    assert.equal(wholeNumberSetting(name, 0, 10), 0);
+    process.env[name] = '10';
+    assert.equal(wholeNumberSetting(name, 0, 10), 10);
+  });
+
+  test('exits on anything else', () => {
+    for (const value of ['11', '-1', '1.5', '1e3', ' 5', 'five']) {
+      process.env[name] = value;
+      assert.throws(() => wholeNumberSetting(name, 0, 10), /exit/);
+    }
+    assert.equal(process.exit.mock.callCount(), 6);
+  });
+});
+
+describe('runInTurn', () => {
+  function deferred() {
+    let resolve, reject;
+    const promise = new Promise((res, rej) => {
+      resolve = res;
+      reject = rej;
+    });
+    return { promise, resolve, reject };
+  }
+
+  test('runs tasks for the same key one after another', async () => {
+    const queues = {};
+    const first = deferred();
+    const events = [];
+    const firstRun = runInTurn(queues, phone, async () => {
+      events.push('first started');
+      await first.promise;
+      events.push('first finished');
+      return 'first';
+    });
+    const secondRun = runInTurn(queues, phone, async () => {
+      events.push('second started');
+      return 'second';
+    });
+    await new Promise((resolve) => setImmediate(resolve));
+    assert.deepEqual(events, ['first started']);
+
+    first.resolve();
+    assert.equal(await firstRun, 'first');
+    assert.equal(await secondRun, 'second');
+    assert.deepEqual(
+      events, ['first started', 'first finished', 'second started']
+    );
+    assert.deepEqual(queues, {});
+  });
+
+  test("doesn't hold up other keys", async () => {
+    const queues = {};
+    const first = deferred();
+    const firstRun = runInTurn(queues, phone, () => first.promise);
+    const other = await runInTurn(queues, '15550000000', () => 'other');
+    assert.equal(other, 'other');
+    first.resolve();
+    await firstRun;
+  });
+
+  test('carries on after a failed task', async () => {
+    const queues = {};
+    const failed = runInTurn(queues, phone, async () => {
+      throw new Error('send failed');
+    });
+    const next = runInTurn(queues, phone, () => 'next');
+    await assert.rejects(failed, /send failed/);
+    assert.equal(await next, 'next');
+    assert.deepEqual(queues, {});
+  });
+});
+
+describe('verifyCode', () => {
+  const code = '12345';
+
+  function setup(settings = {}) {
+    const activeCodes = {};
+    const recentVerifications = new Map();
+    const stats = {
+      verifySuccesses: 0,
+      verifyRetries: 0,
+      verifyFailures: {
+        noActiveCode: 0,
+        noCodeProvided: 0,
+        tooManyCalls: 0,
+        tooManyMalformed: 0,
+        sessionMismatch: 0,
+        tooEarly: 0,
+        tooSoonAfterIncorrect: 0,
+        expired: 0,
+        incorrect: 0
+      }
+    };
+    const verified = [];
+    const verifyCode = createVerifier({
+      activeCodes,
+      recentVerifications,
+      stats,
+      onVerified: (key) => verified.push(key),
+      codeLifetimeInMinutes: 5,
+      ...settings
+    });
+    const storedCode = settings.storedCode ?? ((_phone, value) => value);
+    const addCode = (fields = {}) => {
+      activeCodes[phone] = {
+        code: storedCode(phone, code),
+        expirationTimestamp: new Date(Date.now() + 5 * 60 * 1000),
+        sentTimestamp: new Date(),
+        attempts: 0,
+        verifyCalls: 0,
+        maxVerifyCalls: null,
+        formatFailures: 0,
+        nextGuessTimestamp: null,
+        sessionID: null,
+        messageID: null,
+        deliveryStatus: null,
+        ...fields
+      };
+    };
+    return {
+      activeCodes, recentVerifications, stats, verified, verifyCode, addCode
+    };
+  }
+
+  test('accepts the right code once', () => {
+    const { activeCodes, stats, verified, verifyCode, addCode } = setup();
+    addCode();
+    const result = verifyCode(phone, ' 123-45 ');
+    assert.equal(result.status, 200);
+    assert.deepEqual(result.body, {
+      attempt_number: 1,
+      verified_at: '2024-01-01T00:00:00.000Z'
+    });
+    assert.equal(activeCodes[phone], undefined);
+    assert.deepEqual(verified, [phone]);
+    assert.equal(stats.verifySuccesses, 1);
+
+    const again = verifyCode(phone, code);
+    assert.equal(again.status, 404);
+    assert.equal(again.nextAction, 'RESEND');
+  });
+
+  test('counts incorrect codes', () => {
+    const { stats, verifyCode, addCode } = setup();
+    addCode();
+    const result = verifyCode(phone, '54321');
+    assert.equal(result.status, 401);
+    assert.equal(result.nextAction, 'RETRY');
+    assert.equal(stats.verifyFailures.incorrect, 1);
+    assert.equal(verifyCode(phone, code).body.attempt_number, 2);
+  });
+
+  test('requires a code', () => {
+    const { verifyCode, addCode } = setup();
+    addCode();
+    assert.equal(verifyCode(phone, undefined).status, 400);
+    assert.equal(verifyCode(phone, ' - ').status, 400);
+  });
+
+  test('requires the session that requested the code', () => {
+    const { stats, verifyCode, addCode } = setup();
+    addCode({ sessionID: 'abc' });
+    assert.equal(verifyCode(phone, code).status, 403);
+    assert.equal(verifyCode(phone, code, 'xyz').status, 403);
+    assert.equal(stats.verifyFailures.sessionMismatch, 2);
+    assert.equal(verifyCode(phone, code, 'abc').status, 200);
+  });
+
+  test('turns away codes submitted too soon', () => {
+    const { verifyCode, addCode } = setup({ minSecondsBeforeVerify: 2 });
+    addCode();
+    const result = verifyCode(phone, code);
+    assert.equal(result.status, 425);
+    assert.equal(result.nextAction, 'WAIT');
+    mock.timers.tick(2001);
+    assert.equal(verifyCode(phone, code).status, 200);
+  });
+
+  test('rejects and forgets expired codes', () => {
+    const { activeCodes, verifyCode, addCode } = setup();
+    addCode();
+    mock.timers.tick(5 * 60 * 1000 + 1);
+    const result = verifyCode(phone, code);
+    assert.equal(result.status, 401);
+    assert.equal(result.nextAction, 'RESEND');
+    assert.equal(activeCodes[phone], undefined);
+  });
+
+  test('flags successes within the grace period', () => {
+    const { verifyCode, addCode } = setup({ expiryGraceInSeconds: 30 });
+    addCode();
+    mock.timers.tick(5 * 60 * 1000 + 10 * 1000);
+    const result = verifyCode(phone, code);
+    assert.equal(result.status, 200);
+    assert.equal(result.body.grace, true);
+
+    addCode();
+    mock.timers.tick(5 * 60 * 1000 + 31 * 1000);
+    assert.equal(verifyCode(phone, code).status, 401);
+  });
+
+  test('allows for clock skew without flagging grace', () => {
+    const { verifyCode, addCode } = setup({ clockSkewInSeconds: 10 });
+    addCode();
+    mock.timers.tick(5 * 60 * 1000 + 5 * 1000);
+    const result = verifyCode(phone, code);
+    assert.equal(result.status, 200);
+    assert.equal(result.body.grace, undefined);
+  });
+
+  test('backs off after each incorrect code', () => {
+    const { activeCodes, stats, verifyCode, addCode } =
+      setup({ wrongGuessBackoffInSeconds: 2 });
+    addCode();
+    assert.equal(verifyCode(phone, '00000').status, 401);
+    // even the right code has to wait
+    let result = verifyCode(phone, code);
+    assert.equal(result.status, 429);
+    assert.equal(result.retryAfterInSeconds, 2);
+    assert.equal(stats.verifyFailures.tooSoonAfterIncorrect, 1);
+
+    mock.timers.tick(2000);
+    assert.equal(verifyCode(phone, '00000').status, 401);
+    result = verifyCode(phone, code);
+    assert.equal(result.retryAfterInSeconds, 4);
+
+    // never longer than the code lifetime
+    activeCodes[phone].attempts = 20;
+    activeCodes[phone].nextGuessTimestamp = null;
+    verifyCode(phone, '00000');
+    assert.equal(verifyCode(phone, code).retryAfterInSeconds, 5 * 60);
+  });
+
+  test('deletes the code after too many calls', () => {
+    const { activeCodes, stats, verifyCode, addCode } = setup();
+    addCode({ maxVerifyCalls: 2 });
+    verifyCode(phone, '00000');
+    verifyCode(phone, '00000');
+    const result = verifyCode(phone, code);
+    assert.equal(result.status, 401);
+    assert.equal(result.nextAction, 'RESEND');
+    assert.equal(stats.verifyFailures.tooManyCalls, 1);
+    assert.equal(activeCodes[phone], undefined);
+  });
+
+  test('deletes the code after consecutive malformed codes', () => {
+    const { activeCodes, stats, verifyCode, addCode } =
+      setup({ formatFailuresBeforeDelete: 2 });
+    addCode();
+    verifyCode(phone, 'abc');
+    verifyCode(phone, '00000');
+    verifyCode(phone, 'abc');
+    assert.notEqual(activeCodes[phone], undefined);
+
+    const result = verifyCode(phone, 'abc');
+    assert.equal(result.status, 401);
+    assert.equal(result.nextAction, 'RESEND');
+    assert.equal(stats.verifyFailures.tooManyMalformed, 1);
+    assert.equal(activeCodes[phone], undefined);
+  });
+
+  test('answers retries within the retry window', () => {
+    const { stats, verifyCode, addCode } =
+      setup({ verifyRetryWindowInSeconds: 60 });
+    addCode();
+    const first = verifyCode(phone, code);
+    mock.timers.tick(30 * 1000);
+    const retry = verifyCode(phone, code);
+    assert.equal(retry.status, 200);
+    assert.deepEqual(retry.body, first.body);
+    assert.equal(stats.verifyRetries, 1);
+    assert.equal(verifyCode(phone, '00000').status, 404);
+
+    mock.timers.tick(31 * 1000);
+    assert.equal(verifyCode(phone, code).status, 404);
+  });
+
+  test('remembers a limited number of verifications', () => {
+    const { recentVerifications, verifyCode, activeCodes, addCode } = setup({
+      verifyRetryWindowInSeconds: 60,
+      maxRecentVerifications: 2
+    });
+    for (const other of ['15550000001', '15550000002']) {
+      addCode();
+      activeCodes[other] = activeCodes[phone];
+      delete activeCodes[phone];
+      verifyCode(other, code);
+    }
+    addCode();
+    verifyCode(phone, code);
+    assert.deepEqual(
+      [...recentVerifications.keys()], ['15550000002', phone]
+    );
+  });
+
+  test('compares codes in their stored form', () => {
+    const pepper = 'a'.repeat(32);
+    const storedCode = (_phone, value) => typeof value === 'string'
+      ? crypto.createHmac('sha256', pepper).update(value).digest('hex')
+      : value;
+    const { activeCodes, verifyCode, addCode } = setup({
+      storedCode,
+      phoneKey: (value) => value,
+      verifyRetryWindowInSeconds: 60
+    });
+    addCode();
+    assert.notEqual(activeCodes[phone].code, code);
+    assert.equal(verifyCode(phone, activeCodes[phone].code).status, 401);
+    assert.equal(verifyCode(phone, code).status, 200);
+    assert.equal(verifyCode(phone, code).status, 200);
+  });
+
+  test('signs a proof when given a key', () => {
+    const key = 'k'.repeat(32);
+    const { verifyCode, addCode } = setup({ verificationSigningKey: key });
+    addCode();
+    const { body } = verifyCode(phone, code);
+    assert.equal(
+      verifyProof(key, body.proof, phone, 60).toISOString(), body.verified_at
+    );
+  });
+});
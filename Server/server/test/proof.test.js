@@ -0,0 +1,48 @@
+import assert from 'node:assert/strict';
+import { afterEach, beforeEach, mock, test } from 'node:test';
+import { signProof, verifyProof } from '../proof.js';
+
+const key = 'k'.repeat(32);
+const phone = '15551234567';
+const verifiedAt = new Date(Date.UTC(2024, 0, 1));
+
+beforeEach(() => {
+  mock.timers.enable({ apis: ['Date'], now: verifiedAt.getTime() });
+});
+
+afterEach(() => {
+  mock.timers.reset();
+});
+
+test('accepts its own proofs', () => {
+  const proof = signProof(key, phone, verifiedAt);
+  assert.match(proof, /^[\w-]+\.1704067200\.[\w-]+$/);
+  assert.deepEqual(verifyProof(key, proof, phone, 60), verifiedAt);
+  assert.deepEqual(verifyProof(key, proof, phone), verifiedAt);
+});
+
+test('rejects proofs signed with another key', () => {
+  const proof = signProof('o'.repeat(32), phone, verifiedAt);
+  assert.equal(verifyProof(key, proof, phone, 60), null);
+});
+
+test('rejects proofs for another phone', () => {
+  const proof = signProof(key, phone, verifiedAt);
+  assert.equal(verifyProof(key, proof, '15550000000', 60), null);
+});
+
+test('rejects tampered and malformed proofs', () => {
+  const [hash, , signature] = signProof(key, phone, verifiedAt).split('.');
+  const later = `${hash}.1704067260.${signature}`;
+  assert.equal(verifyProof(key, later, phone), null);
+  assert.equal(verifyProof(key, `${hash}.${signature}`, phone), null);
+  assert.equal(verifyProof(key, `${hash}.x.${signature}`, phone), null);
+  assert.equal(verifyProof(key, undefined, phone), null);
+});
+
+test('rejects proofs older than the maximum age', () => {
+  const proof = signProof(key, phone, verifiedAt);
+  mock.timers.tick(61 * 1000);
+  assert.equal(verifyProof(key, proof, phone, 60), null);
+  assert.deepEqual(verifyProof(key, proof, phone, 120), verifiedAt);
+});